@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// FactMapping declares a single PuppetDB fact that should be attached as an
+// extra Prometheus label on the per-host metrics set by Exporter.scrapePuppetDB.
+// Match/Replace optionally rewrite the fact's value before it's used as a
+// label, the same way statsd_exporter's mapping config rewrites metric names.
+type FactMapping struct {
+	Fact    string `yaml:"fact"`
+	Label   string `yaml:"label,omitempty"`
+	Match   string `yaml:"match,omitempty"`
+	Replace string `yaml:"replace,omitempty"`
+}
+
+// Config is the mapping configuration loaded from the operator-supplied YAML
+// file, declaring which PuppetDB facts should become extra label dimensions.
+type Config struct {
+	Facts []FactMapping `yaml:"facts"`
+}
+
+// builtinLabels are the labels already hard-coded onto the per-host metrics,
+// across all of them. A fact mapping can't reuse one of these names, since
+// extraLabels are appended to every per-host vec's label list and a prometheus.Desc
+// with a duplicate label name is invalid.
+var builtinLabels = map[string]bool{
+	"name":          true,
+	"environment":   true,
+	"host":          true,
+	"deactivated":   true,
+	"resource_type": true,
+	"status":        true,
+}
+
+// LoadConfig reads, parses and validates a mapping config file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %s", err)
+	}
+
+	c := &Config{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %s", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %s", err)
+	}
+
+	return c, nil
+}
+
+// Validate checks that the mapping config's label names are unique and don't
+// collide with a built-in label, since either would produce a vec with a
+// duplicate label name and panic the exporter on registration.
+func (c *Config) Validate() error {
+	seen := make(map[string]string, len(c.Facts))
+	for _, fm := range c.Facts {
+		label := fm.labelName()
+		if builtinLabels[label] {
+			return fmt.Errorf("fact %q maps to label %q, which collides with a built-in label", fm.Fact, label)
+		}
+		if other, ok := seen[label]; ok {
+			return fmt.Errorf("facts %q and %q both map to label %q", other, fm.Fact, label)
+		}
+		seen[label] = fm.Fact
+	}
+	return nil
+}
+
+// labelName returns the Prometheus label name a fact mapping should be
+// exposed as, defaulting to the fact name with dots replaced by underscores
+// since Prometheus label names can't contain dots.
+func (fm FactMapping) labelName() string {
+	if fm.Label != "" {
+		return fm.Label
+	}
+	return strings.ReplaceAll(fm.Fact, ".", "_")
+}
+
+// factNames returns the PuppetDB fact names declared by the mapping config,
+// to be requested via puppetdb.NodeFacts.
+func (c *Config) factNames() []string {
+	names := make([]string, len(c.Facts))
+	for i, fm := range c.Facts {
+		names[i] = fm.Fact
+	}
+	return names
+}
+
+// labelNames returns the extra Prometheus label names contributed by the
+// mapping config, used to extend the label list of the per-host GaugeVecs.
+func (c *Config) labelNames() []string {
+	names := make([]string, len(c.Facts))
+	for i, fm := range c.Facts {
+		names[i] = fm.labelName()
+	}
+	return names
+}
+
+// nodeLabels turns a node's raw fact values into the extra Prometheus labels
+// declared by the mapping config, applying each mapping's regex
+// transformation if one is set.
+func (c *Config) nodeLabels(facts map[string]string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(c.Facts))
+	for _, fm := range c.Facts {
+		value := facts[fm.Fact]
+		if fm.Match != "" {
+			if re, err := regexp.Compile(fm.Match); err == nil {
+				value = re.ReplaceAllString(value, fm.Replace)
+			}
+		}
+		labels[fm.labelName()] = value
+	}
+	return labels
+}
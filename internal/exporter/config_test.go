@@ -0,0 +1,42 @@
+package exporter
+
+import "testing"
+
+func TestConfigValidateRejectsBuiltinCollision(t *testing.T) {
+	c := &Config{Facts: []FactMapping{{Fact: "puppet_environment", Label: "environment"}}}
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for a label colliding with a built-in label")
+	}
+}
+
+func TestConfigValidateRejectsDuplicateLabels(t *testing.T) {
+	c := &Config{Facts: []FactMapping{{Fact: "datacenter"}, {Fact: "dc", Label: "datacenter"}}}
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for two facts mapping to the same label")
+	}
+}
+
+func TestConfigValidateAcceptsDistinctLabels(t *testing.T) {
+	c := &Config{Facts: []FactMapping{{Fact: "datacenter"}, {Fact: "role"}, {Fact: "os.family"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestNodeLabelsDefaultsLabelNameAndRewritesDots(t *testing.T) {
+	c := &Config{Facts: []FactMapping{{Fact: "os.family"}}}
+	labels := c.nodeLabels(map[string]string{"os.family": "RedHat"})
+
+	if labels["os_family"] != "RedHat" {
+		t.Fatalf("expected os_family=RedHat, got %v", labels)
+	}
+}
+
+func TestNodeLabelsAppliesRegexRewrite(t *testing.T) {
+	c := &Config{Facts: []FactMapping{{Fact: "datacenter", Match: "^dc", Replace: "site"}}}
+	labels := c.nodeLabels(map[string]string{"datacenter": "dc1"})
+
+	if labels["datacenter"] != "site1" {
+		t.Fatalf("expected datacenter=site1, got %v", labels)
+	}
+}
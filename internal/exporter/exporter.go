@@ -2,7 +2,9 @@ package exporter
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,11 +13,54 @@ import (
 	"github.com/camptocamp/prometheus-puppetdb-exporter/internal/puppetdb"
 )
 
-// Exporter implements the prometheus.Exporter interface, and exports PuppetDB metrics
+// puppetdbClient is the subset of *puppetdb.PuppetDB's API the exporter
+// depends on. Declaring it as an interface lets scrapePuppetDB be exercised
+// in tests against a fake, without a real PuppetDB to talk to.
+type puppetdbClient interface {
+	Nodes() ([]puppetdb.Node, error)
+	ReportMetrics(hash string) ([]puppetdb.ReportMetric, error)
+	NodeFacts(certname string, factNames []string) (map[string]string, error)
+	ReportEvents(hash string) ([]puppetdb.ReportEvent, error)
+}
+
+// Exporter implements the prometheus.Collector interface, and exports PuppetDB metrics
 type Exporter struct {
-	client    *puppetdb.PuppetDB
-	namespace string
-	metrics   map[string]*prometheus.GaugeVec
+	client             puppetdbClient
+	namespace          string
+	unreportedDuration time.Duration
+	cacheTTL           time.Duration
+	metricTTL          time.Duration
+	purgeDeactivated   bool
+	config             *Config
+
+	metrics  map[string]*prometheus.GaugeVec
+	counters map[string]*prometheus.CounterVec
+
+	mu         sync.Mutex
+	lastScrape time.Time
+	seen       map[string]map[string]seriesEntry
+
+	// processedReports tracks, per host, the last report hash whose events
+	// were added to report_resource_events, so a node's latest report isn't
+	// double counted across scrapes. It isn't persisted, so an exporter
+	// restart re-counts whatever report is currently latest for each node.
+	processedReports map[string]string
+
+	scrapeDuration  prometheus.Gauge
+	scrapesTotal    prometheus.Counter
+	lastScrapeError prometheus.Gauge
+	up              prometheus.Gauge
+
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.CounterVec
+}
+
+// seriesEntry tracks the label set behind a single exported series and when it
+// was last refreshed, so series for nodes that disappear from PuppetDB can be
+// swept once they go stale.
+type seriesEntry struct {
+	labels   prometheus.Labels
+	lastSeen time.Time
 }
 
 var (
@@ -24,10 +69,31 @@ var (
 	}
 )
 
-// NewPuppetDBExporter returns a new exporter of PuppetDB metrics.
-func NewPuppetDBExporter(url, certPath, caPath, keyPath string, sslSkipVerify bool) (e *Exporter, err error) {
+// NewPuppetDBExporter returns a new exporter of PuppetDB metrics. cacheTTL controls
+// how long a scrape's results are reused across successive Collect calls, protecting
+// PuppetDB from being hit on every single Prometheus scrape.
+func NewPuppetDBExporter(url, certPath, caPath, keyPath string, sslSkipVerify bool, unreportedNode string, cacheTTL, metricTTL time.Duration, purgeDeactivated bool, config *Config) (e *Exporter, err error) {
+	unreportedDuration, err := time.ParseDuration(unreportedNode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse unreported duration: %s", err)
+	}
+
+	if config == nil {
+		config = &Config{}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping config: %s", err)
+	}
+
 	e = &Exporter{
-		namespace: "puppetdb",
+		namespace:          "puppetdb",
+		unreportedDuration: unreportedDuration,
+		cacheTTL:           cacheTTL,
+		metricTTL:          metricTTL,
+		purgeDeactivated:   purgeDeactivated,
+		config:             config,
+		seen:               map[string]map[string]seriesEntry{},
+		processedReports:   map[string]string{},
 	}
 
 	opts := &puppetdb.Options{
@@ -45,6 +111,8 @@ func NewPuppetDBExporter(url, certPath, caPath, keyPath string, sslSkipVerify bo
 	}
 
 	e.initGauges()
+	e.initCounters()
+	e.initSelfMetrics()
 
 	return
 }
@@ -54,81 +122,321 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.metrics {
 		m.Describe(ch)
 	}
+	for _, c := range e.counters {
+		c.Describe(ch)
+	}
+	e.scrapeDuration.Describe(ch)
+	e.scrapesTotal.Describe(ch)
+	e.lastScrapeError.Describe(ch)
+	e.up.Describe(ch)
 }
 
-// Collect fetches new metrics from the PuppetDB and updates the appropriate metrics
+// Collect refreshes the exporter's cache from PuppetDB if it has expired, then
+// sends the PuppetDB-derived metrics along with the exporter's own
+// self-observability metrics.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.scrape()
+
 	for _, m := range e.metrics {
 		m.Collect(ch)
 	}
+	for _, c := range e.counters {
+		c.Collect(ch)
+	}
+	e.scrapeDuration.Collect(ch)
+	e.scrapesTotal.Collect(ch)
+	e.lastScrapeError.Collect(ch)
+	e.up.Collect(ch)
 }
 
-// Scrape scrapes PuppetDB and update metrics
-func (e *Exporter) Scrape(interval time.Duration, unreportedNode string) {
-	var statuses map[string]int
+// scrape checks the cache and, if it has expired, queries PuppetDB and
+// records the outcome in the exporter's self-observability metrics. The
+// staleness check and the query both happen under e.mu, so two Collect calls
+// racing past cache expiry still only result in one real scrape; the loser
+// just reuses the cache the winner just populated.
+func (e *Exporter) scrape() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.lastScrape) < e.cacheTTL {
+		return
+	}
+
+	start := time.Now()
+	err := e.scrapePuppetDB()
+	e.lastScrape = start
+
+	e.scrapeDuration.Set(time.Since(start).Seconds())
+	e.scrapesTotal.Inc()
 
-	unreportedDuration, err := time.ParseDuration(unreportedNode)
 	if err != nil {
-		log.Errorf("failed to parse unreported duration: %s", err)
+		log.Errorf("scrape failed: %s", err)
+		e.lastScrapeError.Set(1)
+		e.up.Set(0)
 		return
 	}
 
-	for {
-		statuses = make(map[string]int)
+	e.lastScrapeError.Set(0)
+	e.up.Set(1)
+}
 
-		nodes, err := e.client.Nodes()
+// scrapePuppetDB fetches nodes and their latest report metrics from PuppetDB
+// and updates the per-host gauges.
+func (e *Exporter) scrapePuppetDB() error {
+	statuses := make(map[string]int)
+
+	nodesStart := time.Now()
+	nodes, err := e.client.Nodes()
+	e.recordRequest("nodes", nodesStart, err)
+	if err != nil {
+		return fmt.Errorf("failed to get nodes: %s", err)
+	}
+
+	for _, node := range nodes {
+		var deactivated string
+		if node.Deactivated == "" {
+			deactivated = "false"
+		} else {
+			deactivated = "true"
+		}
+
+		if e.purgeDeactivated && node.Deactivated != "" {
+			e.purgeHost(node.Certname)
+			continue
+		}
+
+		if node.ReportTimestamp == "" {
+			statuses["unreported"]++
+			continue
+		}
+		latestReport, err := time.Parse("2006-01-02T15:04:05Z", node.ReportTimestamp)
 		if err != nil {
-			log.Errorf("failed to get nodes: %s", err)
+			log.Errorf("failed to parse report timestamp: %s", err)
+			continue
 		}
+		extraLabels := e.nodeExtraLabels(node.Certname)
 
-		for _, node := range nodes {
-			var deactivated string
-			if node.Deactivated == "" {
-				deactivated = "false"
-			} else {
-				deactivated = "true"
-			}
+		reportLabels := mergeLabels(prometheus.Labels{"environment": node.ReportEnvironment, "host": node.Certname, "deactivated": deactivated}, extraLabels)
+		e.metrics["report"].With(reportLabels).Set(float64(latestReport.Unix()))
+		e.touch("report", reportLabels)
 
-			if node.ReportTimestamp == "" {
-				statuses["unreported"]++
-				continue
-			}
-			latestReport, err := time.Parse("2006-01-02T15:04:05Z", node.ReportTimestamp)
-			if err != nil {
-				log.Errorf("failed to parse report timestamp: %s", err)
-				continue
-			}
-			e.metrics["report"].With(prometheus.Labels{"environment": node.ReportEnvironment, "host": node.Certname, "deactivated": deactivated}).Set(float64(latestReport.Unix()))
+		if latestReport.Add(e.unreportedDuration).Before(time.Now()) {
+			statuses["unreported"]++
+		}
 
-			if latestReport.Add(unreportedDuration).Before(time.Now()) {
-				statuses["unreported"]++
+		if node.LatestReportStatus != "" {
+			statuses[node.LatestReportStatus]++
+		} else {
+			statuses["unreported"]++
+		}
+
+		if node.LatestReportHash != "" {
+			metricsStart := time.Now()
+			reportMetrics, err := e.client.ReportMetrics(node.LatestReportHash)
+			e.recordRequest("report_metrics", metricsStart, err)
+			for _, reportMetric := range reportMetrics {
+				category := fmt.Sprintf("report_%s", reportMetric.Category)
+				metricLabels := mergeLabels(prometheus.Labels{"name": strings.ReplaceAll(strings.Title(reportMetric.Name), "_", " "), "environment": node.ReportEnvironment, "host": node.Certname}, extraLabels)
+				e.metrics[category].With(metricLabels).Set(reportMetric.Value)
+				e.touch(category, metricLabels)
 			}
 
-			if node.LatestReportStatus != "" {
-				statuses[node.LatestReportStatus]++
+			// Events are only re-fetched when the report hash changes, since the
+			// last report's events don't change between scrapes and re-adding
+			// them would double count. The counter's series are still touched
+			// every scrape below so they don't get swept by sweepExpired while
+			// the node keeps reporting the same hash.
+			if e.processedReports[node.Certname] != node.LatestReportHash {
+				eventsStart := time.Now()
+				events, err := e.client.ReportEvents(node.LatestReportHash)
+				e.recordRequest("events", eventsStart, err)
+				if err != nil {
+					log.Errorf("failed to get report events for %s: %s", node.Certname, err)
+				} else {
+					for _, event := range events {
+						eventLabels := mergeLabels(prometheus.Labels{"resource_type": event.ResourceType, "status": event.Status, "environment": node.ReportEnvironment, "host": node.Certname}, extraLabels)
+						e.counters["report_resource_events"].With(eventLabels).Inc()
+						e.touch("report_resource_events", eventLabels)
+					}
+					e.processedReports[node.Certname] = node.LatestReportHash
+				}
 			} else {
-				statuses["unreported"]++
+				e.touchHost("report_resource_events", node.Certname)
 			}
+		}
+	}
 
-			if node.LatestReportHash != "" {
-				reportMetrics, _ := e.client.ReportMetrics(node.LatestReportHash)
-				for _, reportMetric := range reportMetrics {
-					category := fmt.Sprintf("report_%s", reportMetric.Category)
-					e.metrics[category].With(prometheus.Labels{"name": strings.ReplaceAll(strings.Title(reportMetric.Name), "_", " "), "environment": node.ReportEnvironment, "host": node.Certname}).Set(reportMetric.Value)
-				}
+	for statusName, statusValue := range statuses {
+		e.metrics["node_report_status_count"].With(prometheus.Labels{"status": statusName}).Set(float64(statusValue))
+	}
+
+	e.sweepExpired()
+
+	return nil
+}
+
+// touch records that the given series is still present as of now, so it
+// survives the next sweepExpired pass.
+func (e *Exporter) touch(metric string, labels prometheus.Labels) {
+	if e.seen[metric] == nil {
+		e.seen[metric] = map[string]seriesEntry{}
+	}
+	e.seen[metric][labelsKey(labels)] = seriesEntry{labels: labels, lastSeen: time.Now()}
+}
+
+// touchHost refreshes lastSeen for every series already tracked under metric
+// for host, without changing their label sets or values. Used when a node's
+// latest report hash hasn't changed since the last scrape, so its series
+// still survive sweepExpired even though nothing new was fetched.
+func (e *Exporter) touchHost(metric, host string) {
+	for _, entry := range e.seen[metric] {
+		if entry.labels["host"] == host {
+			e.touch(metric, entry.labels)
+		}
+	}
+}
+
+// sweepExpired deletes series that haven't been touched within metricTTL, so
+// nodes that are decommissioned or renamed don't leave stale timeseries behind
+// forever.
+func (e *Exporter) sweepExpired() {
+	if e.metricTTL <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-e.metricTTL)
+	for metric, entries := range e.seen {
+		for key, entry := range entries {
+			if entry.lastSeen.Before(cutoff) {
+				e.deleteSeries(metric, entry.labels)
+				delete(entries, key)
 			}
 		}
+	}
+
+	e.pruneProcessedReports()
+}
 
-		for statusName, statusValue := range statuses {
-			e.metrics["node_report_status_count"].With(prometheus.Labels{"status": statusName}).Set(float64(statusValue))
+// pruneProcessedReports drops processedReports entries for hosts that no
+// longer have any series left in e.seen, so a node that disappears from
+// PuppetDB (renamed, decommissioned) doesn't leak an entry forever when
+// --purge-deactivated isn't set.
+func (e *Exporter) pruneProcessedReports() {
+	live := map[string]bool{}
+	for _, entries := range e.seen {
+		for _, entry := range entries {
+			live[entry.labels["host"]] = true
 		}
+	}
 
-		time.Sleep(interval)
+	for host := range e.processedReports {
+		if !live[host] {
+			delete(e.processedReports, host)
+		}
 	}
 }
 
+// deleteSeries removes a single label combination from whichever vec, gauge
+// or counter, is registered under metric.
+func (e *Exporter) deleteSeries(metric string, labels prometheus.Labels) {
+	if m, ok := e.metrics[metric]; ok {
+		m.Delete(labels)
+		return
+	}
+	if c, ok := e.counters[metric]; ok {
+		c.Delete(labels)
+	}
+}
+
+// purgeHost immediately deletes every series for certname across all managed
+// metrics, used when a node is reported as deactivated and --purge-deactivated
+// is set.
+func (e *Exporter) purgeHost(certname string) {
+	for metric, entries := range e.seen {
+		for key, entry := range entries {
+			if entry.labels["host"] == certname {
+				e.deleteSeries(metric, entry.labels)
+				delete(entries, key)
+			}
+		}
+	}
+	delete(e.processedReports, certname)
+}
+
+// nodeExtraLabels fetches the facts declared by the mapping config for
+// certname and turns them into extra Prometheus labels. Every vec with a
+// mapping config configured has the full set of extra label names baked into
+// it at construction time, so on a NodeFacts error this still returns that
+// full set, built from empty fact values, rather than an empty map: a GaugeVec.With
+// call with fewer labels than the vec was constructed with panics with
+// "inconsistent label cardinality", which would take down the whole exporter
+// over a single node's failed facts query.
+func (e *Exporter) nodeExtraLabels(certname string) prometheus.Labels {
+	factNames := e.config.factNames()
+	if len(factNames) == 0 {
+		return prometheus.Labels{}
+	}
+
+	factsStart := time.Now()
+	facts, err := e.client.NodeFacts(certname, factNames)
+	e.recordRequest("facts", factsStart, err)
+	if err != nil {
+		log.Errorf("failed to get facts for %s: %s", certname, err)
+		return e.config.nodeLabels(map[string]string{})
+	}
+
+	return e.config.nodeLabels(facts)
+}
+
+// mergeLabels combines a metric's base labels with the extra labels
+// contributed by the mapping config.
+func mergeLabels(base, extra prometheus.Labels) prometheus.Labels {
+	merged := make(prometheus.Labels, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+// recordRequest accounts for a single call to PuppetDB against the
+// requestsTotal/requestDuration telemetry counters, keyed by endpoint.
+func (e *Exporter) recordRequest(endpoint string, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	e.requestsTotal.WithLabelValues(endpoint, status).Inc()
+	e.requestDuration.WithLabelValues(endpoint).Add(time.Since(start).Seconds())
+}
+
+// labelsKey builds a stable map key for a label set, independent of iteration order.
+func labelsKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// initGauges builds the per-host GaugeVecs, extending their label lists with
+// any extra labels declared by the mapping config. Label sets must be
+// declared at GaugeVec construction time, so this has to run after the
+// config is loaded and before the first scrape.
 func (e *Exporter) initGauges() {
 	e.metrics = map[string]*prometheus.GaugeVec{}
+	extraLabels := e.config.labelNames()
 
 	e.metrics["node_report_status_count"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: e.namespace,
@@ -140,33 +448,86 @@ func (e *Exporter) initGauges() {
 		Namespace: "puppet",
 		Name:      "report_resources",
 		Help:      "Total count of resources per status",
-	}, []string{"name", "environment", "host"})
+	}, append([]string{"name", "environment", "host"}, extraLabels...))
 
 	e.metrics["report_time"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "puppet",
 		Name:      "report_time",
 		Help:      "Total execution time per resource type",
-	}, []string{"name", "environment", "host"})
+	}, append([]string{"name", "environment", "host"}, extraLabels...))
 
 	e.metrics["report_changes"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "puppet",
 		Name:      "report_changes",
 		Help:      "Total count of resources changed",
-	}, []string{"name", "environment", "host"})
+	}, append([]string{"name", "environment", "host"}, extraLabels...))
 
 	e.metrics["report_events"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "puppet",
 		Name:      "report_events",
 		Help:      "Total count of resources per event",
-	}, []string{"name", "environment", "host"})
+	}, append([]string{"name", "environment", "host"}, extraLabels...))
 
 	e.metrics["report"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "puppet",
 		Name:      "report",
 		Help:      "Timestamp of latest report",
-	}, []string{"environment", "host", "deactivated"})
+	}, append([]string{"environment", "host", "deactivated"}, extraLabels...))
+}
 
-	for _, m := range e.metrics {
-		prometheus.MustRegister(m)
-	}
+// initCounters builds the CounterVecs derived from report events, extended
+// with any extra labels declared by the mapping config. These are kept
+// separate from e.metrics because they're monotonic counters, not gauges.
+func (e *Exporter) initCounters() {
+	e.counters = map[string]*prometheus.CounterVec{}
+	extraLabels := e.config.labelNames()
+
+	e.counters["report_resource_events"] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "puppet",
+		Name:      "report_resource_events_total",
+		Help:      "Total count of resource events by resource type and status",
+	}, append([]string{"resource_type", "status", "environment", "host"}, extraLabels...))
+}
+
+// initSelfMetrics creates the metrics the exporter reports about its own
+// health, as distinct from the PuppetDB-derived metrics in e.metrics.
+func (e *Exporter) initSelfMetrics() {
+	e.scrapeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "last_scrape_duration_seconds",
+		Help:      "Duration of the last scrape of PuppetDB",
+	})
+
+	e.scrapesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "scrapes_total",
+		Help:      "Total number of scrapes of PuppetDB",
+	})
+
+	e.lastScrapeError = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "last_scrape_error",
+		Help:      "Whether the last scrape of PuppetDB resulted in an error (1 for error, 0 for success)",
+	})
+
+	e.up = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Name:      "up",
+		Help:      "Whether the last query of PuppetDB succeeded",
+	})
+
+	e.requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: e.namespace,
+		Name:      "requests_total",
+		Help:      "Total number of requests made to PuppetDB, by endpoint and status",
+	}, []string{"endpoint", "status"})
+
+	e.requestDuration = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: e.namespace,
+		Name:      "request_duration_seconds_total",
+		Help:      "Total time spent making requests to PuppetDB, by endpoint",
+	}, []string{"endpoint"})
 }
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/prometheus-puppetdb-exporter/internal/puppetdb"
+)
+
+// fakeClient is a minimal puppetdbClient for exercising scrapePuppetDB and
+// scrape's caching behaviour without talking to a real PuppetDB.
+type fakeClient struct {
+	nodes      []puppetdb.Node
+	nodesCalls int
+	factsErr   error
+}
+
+func (f *fakeClient) Nodes() ([]puppetdb.Node, error) {
+	f.nodesCalls++
+	return f.nodes, nil
+}
+
+func (f *fakeClient) ReportMetrics(hash string) ([]puppetdb.ReportMetric, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) NodeFacts(certname string, factNames []string) (map[string]string, error) {
+	if f.factsErr != nil {
+		return nil, f.factsErr
+	}
+	return map[string]string{}, nil
+}
+
+func (f *fakeClient) ReportEvents(hash string) ([]puppetdb.ReportEvent, error) {
+	return nil, nil
+}
+
+func newTestExporter(client puppetdbClient, config *Config) *Exporter {
+	if config == nil {
+		config = &Config{}
+	}
+	e := &Exporter{
+		namespace:          "puppetdb",
+		unreportedDuration: time.Hour,
+		config:             config,
+		client:             client,
+		seen:               map[string]map[string]seriesEntry{},
+		processedReports:   map[string]string{},
+	}
+	e.initGauges()
+	e.initCounters()
+	e.initSelfMetrics()
+	return e
+}
+
+func TestScrapeReusesCacheWithinTTL(t *testing.T) {
+	client := &fakeClient{}
+	e := newTestExporter(client, nil)
+	e.cacheTTL = time.Hour
+
+	e.scrape()
+	e.scrape()
+
+	if client.nodesCalls != 1 {
+		t.Fatalf("expected 1 call to Nodes within cacheTTL, got %d", client.nodesCalls)
+	}
+}
+
+func TestScrapeRefetchesAfterCacheExpires(t *testing.T) {
+	client := &fakeClient{}
+	e := newTestExporter(client, nil)
+	e.cacheTTL = time.Millisecond
+
+	e.scrape()
+	time.Sleep(2 * time.Millisecond)
+	e.scrape()
+
+	if client.nodesCalls != 2 {
+		t.Fatalf("expected 2 calls to Nodes after cacheTTL expired, got %d", client.nodesCalls)
+	}
+}
+
+func TestSweepExpiredRemovesStaleSeriesAndProcessedReports(t *testing.T) {
+	e := newTestExporter(&fakeClient{}, nil)
+	e.metricTTL = time.Millisecond
+
+	labels := map[string]string{"environment": "prod", "host": "node1", "deactivated": "false"}
+	e.metrics["report"].With(labels).Set(1)
+	e.touch("report", labels)
+	e.processedReports["node1"] = "hash1"
+
+	time.Sleep(2 * time.Millisecond)
+	e.sweepExpired()
+
+	if _, ok := e.seen["report"][labelsKey(labels)]; ok {
+		t.Fatal("expected stale series to be swept")
+	}
+	if _, ok := e.processedReports["node1"]; ok {
+		t.Fatal("expected processedReports entry to be pruned once its series was swept")
+	}
+}
+
+func TestSweepExpiredKeepsProcessedReportsForLiveHosts(t *testing.T) {
+	e := newTestExporter(&fakeClient{}, nil)
+	e.metricTTL = time.Hour
+
+	labels := map[string]string{"environment": "prod", "host": "node1", "deactivated": "false"}
+	e.metrics["report"].With(labels).Set(1)
+	e.touch("report", labels)
+	e.processedReports["node1"] = "hash1"
+
+	e.sweepExpired()
+
+	if _, ok := e.processedReports["node1"]; !ok {
+		t.Fatal("expected processedReports entry to survive while its series is still live")
+	}
+}
+
+func TestNodeExtraLabelsOnFactsErrorKeepsVecCardinality(t *testing.T) {
+	config := &Config{Facts: []FactMapping{{Fact: "datacenter"}, {Fact: "role"}}}
+	client := &fakeClient{factsErr: fmt.Errorf("facts query failed")}
+	e := newTestExporter(client, config)
+
+	labels := e.nodeExtraLabels("node1")
+
+	if len(labels) != len(config.Facts) {
+		t.Fatalf("expected %d labels to keep cardinality stable, got %d: %v", len(config.Facts), len(labels), labels)
+	}
+}
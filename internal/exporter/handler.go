@@ -0,0 +1,51 @@
+package exporter
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// BuildInfo holds the version metadata surfaced through the
+// puppetdb_exporter_build_info metric.
+type BuildInfo struct {
+	Version   string
+	Revision  string
+	Branch    string
+	GoVersion string
+}
+
+// NewHandler returns an http.Handler serving /metrics from two separate
+// registries: one holding e itself, i.e. the PuppetDB-derived metrics along
+// with e's scrape health metrics (last scrape duration and error, scrape
+// count, up), and a telemetry registry holding Go/process runtime metrics, the
+// exporter's build info, and instrumentation for requests made against
+// PuppetDB. This keeps e out of the global registry, so more than one Exporter
+// can run in-process.
+func NewHandler(e *Exporter, build BuildInfo) http.Handler {
+	puppetdbRegistry := prometheus.NewRegistry()
+	puppetdbRegistry.MustRegister(e)
+
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "build_info",
+		Help:      "A metric with a constant '1' value labeled by version, revision, branch, and goversion from which puppetdb_exporter was built",
+	}, []string{"version", "revision", "branch", "goversion"})
+	buildInfo.WithLabelValues(build.Version, build.Revision, build.Branch, build.GoVersion).Set(1)
+
+	telemetryRegistry := prometheus.NewRegistry()
+	telemetryRegistry.MustRegister(prometheus.NewGoCollector())
+	telemetryRegistry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	telemetryRegistry.MustRegister(buildInfo)
+	telemetryRegistry.MustRegister(e.requestsTotal)
+	telemetryRegistry.MustRegister(e.requestDuration)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
+		prometheus.Gatherers{puppetdbRegistry, telemetryRegistry},
+		promhttp.HandlerOpts{},
+	))
+	return mux
+}
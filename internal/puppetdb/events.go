@@ -0,0 +1,19 @@
+package puppetdb
+
+import "fmt"
+
+// ReportEvent is a single resource event from a report's /events sub-query.
+type ReportEvent struct {
+	ResourceType string `json:"resource_type"`
+	Status       string `json:"status"`
+}
+
+// ReportEvents returns the resource events recorded against the report hash.
+func (p *PuppetDB) ReportEvents(hash string) ([]ReportEvent, error) {
+	var events []ReportEvent
+	path := fmt.Sprintf("/pdb/query/v4/reports/%s/events", hash)
+	if err := p.query(path, nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
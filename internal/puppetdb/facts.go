@@ -0,0 +1,42 @@
+package puppetdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type fact struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// NodeFacts returns the values of factNames for certname, queried against
+// PuppetDB's /pdb/query/v4/facts endpoint. Facts that PuppetDB has no value
+// for are simply absent from the returned map.
+func (p *PuppetDB) NodeFacts(certname string, factNames []string) (map[string]string, error) {
+	if len(factNames) == 0 {
+		return map[string]string{}, nil
+	}
+
+	query := fmt.Sprintf(`["and", ["=", "certname", %s], ["in", "name", ["array", [%s]]]]`, strconv.Quote(certname), quoteNames(factNames))
+
+	var facts []fact
+	if err := p.query("/pdb/query/v4/facts", map[string]string{"query": query}, &facts); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(facts))
+	for _, f := range facts {
+		values[f.Name] = fmt.Sprintf("%v", f.Value)
+	}
+	return values, nil
+}
+
+func quoteNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = strconv.Quote(name)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,139 @@
+package puppetdb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// requestTimeout bounds every HTTP request this client makes to PuppetDB, so
+// a PuppetDB that stops responding can't hang a caller (e.g. Exporter.scrape,
+// which holds a lock for the duration of the request) forever.
+const requestTimeout = 10 * time.Second
+
+// Options configures a PuppetDB client.
+type Options struct {
+	URL        string
+	CertPath   string
+	CACertPath string
+	KeyPath    string
+	SSLVerify  bool
+}
+
+// PuppetDB is a client for PuppetDB's HTTP API.
+type PuppetDB struct {
+	url        string
+	httpClient *http.Client
+}
+
+// Node is a single entry from PuppetDB's /pdb/query/v4/nodes endpoint.
+type Node struct {
+	Certname           string `json:"certname"`
+	Deactivated        string `json:"deactivated"`
+	ReportTimestamp    string `json:"report_timestamp"`
+	ReportEnvironment  string `json:"report_environment"`
+	LatestReportStatus string `json:"latest_report_status"`
+	LatestReportHash   string `json:"latest_report_hash"`
+}
+
+// ReportMetric is a single entry from a report's /metrics sub-query.
+type ReportMetric struct {
+	Category string  `json:"category"`
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+}
+
+// NewClient returns a new PuppetDB client configured from opts.
+func NewClient(opts *Options) (*PuppetDB, error) {
+	httpClient := &http.Client{Timeout: requestTimeout}
+
+	if opts.CertPath != "" || opts.KeyPath != "" || opts.CACertPath != "" {
+		cfg, err := buildTLSConfig(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build TLS config: %s", err)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+
+	return &PuppetDB{
+		url:        opts.URL,
+		httpClient: httpClient,
+	}, nil
+}
+
+func buildTLSConfig(opts *Options) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: !opts.SSLVerify}
+
+	if opts.CertPath != "" && opts.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(opts.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(caCert)
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// Nodes returns every node known to PuppetDB.
+func (p *PuppetDB) Nodes() ([]Node, error) {
+	var nodes []Node
+	if err := p.query("/pdb/query/v4/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// ReportMetrics returns the metrics recorded against the report hash.
+func (p *PuppetDB) ReportMetrics(hash string) ([]ReportMetric, error) {
+	var metrics []ReportMetric
+	path := fmt.Sprintf("/pdb/query/v4/reports/%s/metrics", hash)
+	if err := p.query(path, nil, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// query issues a GET against path with the given query-string params and
+// decodes the JSON response into out.
+func (p *PuppetDB) query(path string, params map[string]string, out interface{}) error {
+	u, err := url.Parse(p.url + path)
+	if err != nil {
+		return fmt.Errorf("failed to build request URL: %s", err)
+	}
+
+	if len(params) > 0 {
+		q := u.Query()
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	resp, err := p.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}